@@ -1,13 +1,24 @@
 // checkdeps is a tool analyze rust Cargo.lock files and figure out why
-// there are multiple versions of some transitive dependencies.
+// there are multiple versions of some transitive dependencies.  It
+// understands both the legacy v1 lockfile format and the v2/v3/v4 formats
+// emitted by modern Cargo, including the bare-name dependency shorthand and
+// per-package checksums those formats introduce.
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	toml "github.com/pelletier/go-toml"
@@ -15,9 +26,10 @@ import (
 
 // Represents a package in the Cargo.lock file.
 type Package struct {
-	Name string `toml:"name"`
-	Ver  string `toml:"version"`
-	Src  string `toml:"source"`
+	Name     string `toml:"name"`
+	Ver      string `toml:"version"`
+	Src      string `toml:"source"`
+	Checksum string `toml:"checksum"`
 
 	DepStrings []string `toml:"dependencies"`
 	Deps       []Dep    `toml:"-"`
@@ -31,6 +43,11 @@ type Package struct {
 	// The number of packages which depend on this one.
 	incoming int
 
+	// The packages which depend on this one.  Populated by makePkgMap,
+	// alongside incoming, so that -explain can walk the dependency graph
+	// in reverse from a duplicated package back to its workspace roots.
+	dependents []*Package
+
 	// Strictly more packages depend on this version of the package than on
 	// other versions.
 	popular bool
@@ -38,6 +55,25 @@ type Package struct {
 	// This package is in the transitive dependencies of a package that has
 	// more than one version and is not "popular."
 	depOfMulti bool
+
+	// compatBucket groups this version together with the other versions of
+	// the same package that are semver-compatible with it under Cargo's
+	// default `^` requirement semantics.  Populated by makePkgMap.
+	compatBucket string
+
+	// This version is semver-compatible with, and older than, some other
+	// version of the same package: in principle Cargo's resolver could
+	// have unified onto that version instead of keeping this one around.
+	avoidable bool
+
+	// The version, if any, which dominates this one within its
+	// compatBucket and caused avoidable to be set.
+	dominatedBy string
+
+	// This package is a member of the workspace under analysis: either
+	// named by the -workspace manifest, or, absent that flag, guessed from
+	// having no recorded source.  Populated by markWorkspaceRoots.
+	isWorkspaceRoot bool
 }
 
 // Write the most appropriate URL for this package to the given target.
@@ -45,10 +81,13 @@ type Package struct {
 // If specific is true, it will write a URL to the specific version of the
 // package, otherwise to the overall project.
 //
-// baseurl is the URL prefix to use for crates which do not have a source
-// specified.  The url will be baseurl/<crate>/Cargo.toml, on the assumption
-// that these are local crates within a workspace.
-func (pkg *Package) WriteUrl(w *os.File, specific bool, baseurl string) {
+// baseurl is the URL prefix to use for workspace member crates.  The url
+// will be baseurl/<crate>/Cargo.toml.
+//
+// When specific is true and a registry package has a known checksum, the URL is
+// pinned to that checksum via a fragment so the exact artifact being
+// referenced can be verified.
+func (pkg *Package) WriteUrl(w io.Writer, specific bool, baseurl string) {
 	if strings.HasPrefix(pkg.Src, "git+http") {
 		rawurl := strings.TrimPrefix(pkg.Src, "git+")
 		u, err := url.Parse(rawurl)
@@ -70,7 +109,7 @@ func (pkg *Package) WriteUrl(w *os.File, specific bool, baseurl string) {
 		} else {
 			writeString(w, rawurl)
 		}
-	} else if pkg.Src == "" && baseurl != "" {
+	} else if pkg.isWorkspaceRoot && baseurl != "" {
 		writeString(w, baseurl)
 		if baseurl[len(baseurl)-1] != '/' {
 			writeString(w, "/")
@@ -83,6 +122,10 @@ func (pkg *Package) WriteUrl(w *os.File, specific bool, baseurl string) {
 		if specific {
 			writeString(w, "/")
 			writeString(w, pkg.Ver)
+			if pkg.Checksum != "" {
+				writeString(w, "#checksum=")
+				writeString(w, pkg.Checksum)
+			}
 		}
 	} else {
 		writeString(w, `https://crates.io/search?q=`)
@@ -90,9 +133,106 @@ func (pkg *Package) WriteUrl(w *os.File, specific bool, baseurl string) {
 	}
 }
 
-// Represents a dependency for a package in the Cargo.lock file.  This is parsed
-// from a string, e.g.
-// "vector_utils 0.1.0 (registry+https://github.com/rust-lang/crates.io-index)"
+// semverRe matches the major.minor.patch[-prerelease] prefix of a version
+// string.  Build metadata (a trailing +...) is not captured since it plays
+// no part in compatibility.
+var semverRe = regexp.MustCompile(`^(\d+)\.(\d+)\.(\d+)(?:-([0-9A-Za-z.-]+))?`)
+
+// parseSemver extracts the major, minor and patch numbers and the
+// pre-release identifier, if any, from the start of v.  ok is false if v
+// does not begin with a dotted triple of numbers.
+func parseSemver(v string) (major, minor, patch int, pre string, ok bool) {
+	m := semverRe.FindStringSubmatch(v)
+	if m == nil {
+		return 0, 0, 0, "", false
+	}
+	major, _ = strconv.Atoi(m[1])
+	minor, _ = strconv.Atoi(m[2])
+	patch, _ = strconv.Atoi(m[3])
+	return major, minor, patch, m[4], true
+}
+
+// semverLess reports whether a is an older version than b.  Versions which
+// fail to parse as semver are compared lexically.
+func semverLess(a, b string) bool {
+	aMaj, aMin, aPatch, aPre, aOk := parseSemver(a)
+	bMaj, bMin, bPatch, bPre, bOk := parseSemver(b)
+	if !aOk || !bOk {
+		return a < b
+	}
+	if aMaj != bMaj {
+		return aMaj < bMaj
+	}
+	if aMin != bMin {
+		return aMin < bMin
+	}
+	if aPatch != bPatch {
+		return aPatch < bPatch
+	}
+	if aPre == bPre {
+		return false
+	}
+	// A version without a pre-release identifier is newer than one with.
+	if aPre == "" {
+		return false
+	}
+	if bPre == "" {
+		return true
+	}
+	return aPre < bPre
+}
+
+// gitCommitKey extracts the commit hash a git source is pinned to, so that
+// packages fetched from the same repo at the same commit can share a
+// compatBucket.  Falls back to the raw source string when no commit
+// fragment is present.
+func gitCommitKey(src string) string {
+	rawurl := strings.TrimPrefix(src, "git+")
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Fragment == "" {
+		return src
+	}
+	return u.Fragment
+}
+
+// computeCompatBucket returns a key such that two versions of the same
+// package are semver-compatible under Cargo's default `^` requirement
+// semantics if and only if they share a bucket: `^1.2.3` covers any
+// `1.y.z`, `^0.2.3` covers any `0.2.z`, and `^0.0.3` covers only `0.0.3`.
+// Pre-release versions and git sources never unify with anything else, so
+// each gets a bucket of its own.  Two packages also only share a bucket
+// if they come from the same source: Cargo can never unify a registry
+// crate with a git dependency, nor two crates of the same name pulled
+// from different registries, even when their versions are otherwise
+// semver-compatible.
+func (pkg *Package) computeCompatBucket() string {
+	if strings.HasPrefix(pkg.Src, "git+") {
+		return "git:" + gitCommitKey(pkg.Src)
+	}
+	major, minor, patch, pre, ok := parseSemver(pkg.Ver)
+	if !ok {
+		return "unparsed:" + pkg.Src + ":" + pkg.Ver
+	}
+	if pre != "" {
+		return fmt.Sprintf("pre:%s:%d.%d.%d-%s", pkg.Src, major, minor, patch, pre)
+	}
+	switch {
+	case major > 0:
+		return fmt.Sprintf("%s:%d", pkg.Src, major)
+	case minor > 0:
+		return fmt.Sprintf("%s:0.%d", pkg.Src, minor)
+	default:
+		return fmt.Sprintf("%s:0.0.%d", pkg.Src, patch)
+	}
+}
+
+// Represents a dependency for a package in the Cargo.lock file.  This is
+// parsed from a string.  In the legacy v1 lockfile format this looks like
+// "vector_utils 0.1.0 (registry+https://github.com/rust-lang/crates.io-index)";
+// in the v2+ format the source is omitted and the version itself is dropped
+// whenever the name alone is unambiguous, e.g. "vector_utils" or
+// "vector_utils 0.1.0".  A bare name is resolved to a concrete version by
+// makePkgMap once the full set of packages is known.
 type Dep struct {
 	Name string
 	Ver  string
@@ -102,7 +242,7 @@ type Dep struct {
 	Pkg *Package
 }
 
-var depsRe = regexp.MustCompile(`(\S+)\s+(\S+)(?:\s\(([^)]+)\))?`)
+var depsRe = regexp.MustCompile(`^(\S+)(?:\s+(\S+))?(?:\s\(([^)]+)\))?$`)
 
 func (p *Package) ParseDeps() error {
 	if len(p.DepStrings) == 0 {
@@ -133,12 +273,24 @@ func loadCrates(filename string) ([]*Package, error) {
 	defer f.Close()
 	dec := toml.NewDecoder(f)
 	var result struct {
-		Packages []*Package `toml:"package"`
+		// The lockfile format version.  Absent (zero) in the legacy v1
+		// format; 2, 3 or 4 in modern Cargo.lock files.  v1 is the only
+		// format with a separate [metadata] table of checksums, which is
+		// not parsed here.
+		LockVersion int        `toml:"version"`
+		Packages    []*Package `toml:"package"`
 	}
 	err = dec.Decode(&result)
 	if err != nil {
 		return result.Packages, err
 	}
+	switch result.LockVersion {
+	case 0, 2, 3, 4:
+		// Known formats; see the LockVersion doc comment above.
+	default:
+		fmt.Fprintln(os.Stderr, "warning: unrecognized Cargo.lock version", result.LockVersion,
+			"-- parsing as v2+, results may be unreliable")
+	}
 	for _, pkg := range result.Packages {
 		if err := pkg.ParseDeps(); err != nil {
 			return result.Packages, err
@@ -148,38 +300,134 @@ func loadCrates(filename string) ([]*Package, error) {
 }
 
 func main() {
-	var dot, trim bool
+	var dot, trim, explain, jsonOut, htmlOut bool
 	flag.BoolVar(&dot, "dot", false,
 		"Render deps graph in dot format.")
+	flag.BoolVar(&jsonOut, "json", false,
+		"Render the fully-resolved deps graph as JSON.")
+	flag.BoolVar(&htmlOut, "html", false,
+		"Render an interactive, self-contained HTML page with collapsible "+
+			"clusters, click-to-highlight duplicate paths, and a name "+
+			"filter.  Requires graphviz's \"dot\" to be on PATH.")
 	flag.BoolVar(&trim, "trim", false,
 		"Remove nodes from the graph if they do not depend "+
 			"transitively on a package for which more than one version exists.")
+	flag.BoolVar(&explain, "explain", false,
+		"For every package with more than one version, print each "+
+			"distinct path from a workspace root that pulls it in.")
 	var baseurl string
 	flag.StringVar(&baseurl, "baseurl", "",
 		"A `url` prefix to use for making hyperlinks for packages in this "+
 			"workspace, e.g. https://github.com/<org>/<repo>/blob/master/")
+	var manifestDir string
+	flag.StringVar(&manifestDir, "manifest-dir", "",
+		"A `directory` to search recursively for Cargo.toml manifests, "+
+			"used to annotate dependency edges with the semver requirement "+
+			"that pulled them in.")
+	var workspaceDir string
+	flag.StringVar(&workspaceDir, "workspace", "",
+		"The `directory` containing the workspace's root Cargo.toml, used "+
+			"to identify workspace member crates instead of guessing from "+
+			"which packages have no recorded source.")
 	flag.Parse()
 	pkgs, err := loadCrates(flag.Arg(0))
 	if err != nil {
 		panic(err.Error())
 	}
 	pkgMap := makePkgMap(pkgs)
+	var workspaceNames map[string]bool
+	if workspaceDir != "" {
+		workspaceNames, err = parseWorkspace(workspaceDir)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	markWorkspaceRoots(pkgs, workspaceNames)
 	if trim {
 		pkgs = trimPkgs(pkgMap, pkgs)
 	}
+	var reqs map[string]map[string]string
+	if manifestDir != "" {
+		reqs, err = parseManifests(manifestDir)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
 
-	if dot {
-		writeDot(pkgs, baseurl, os.Stdout)
+	if explain {
+		explainDups(pkgs, reqs)
+	} else if dot {
+		writeDot(pkgs, baseurl, reqs, os.Stdout)
+	} else if jsonOut {
+		if err := writeJSON(pkgs, baseurl, os.Stdout); err != nil {
+			panic(err.Error())
+		}
+	} else if htmlOut {
+		if err := writeHTML(pkgs, baseurl, reqs, os.Stdout); err != nil {
+			panic(err.Error())
+		}
 	} else {
 		for _, pkg := range pkgs {
 			if pkg.versions == 1 && pkg.depVersions > 1 && !pkg.depOfMulti {
 				for _, dep := range pkg.Deps {
 					if dep.Pkg.versions > 1 {
-						fmt.Println(pkg.Name, "@", pkg.Ver, "brings in", dep.Name, "@", dep.Ver)
+						if dep.Pkg.Checksum != "" {
+							fmt.Println(pkg.Name, "@", pkg.Ver, "brings in", dep.Name, "@",
+								dep.Ver, "(checksum", dep.Pkg.Checksum+")")
+						} else {
+							fmt.Println(pkg.Name, "@", pkg.Ver, "brings in", dep.Name, "@", dep.Ver)
+						}
 					}
 				}
 			}
 		}
+		printDupSummary(pkgMap)
+	}
+}
+
+// printDupSummary prints a one-line summary for every package with more
+// than one version, noting how many of its versions are avoidable (i.e.
+// semver-compatible with, and older than, some other version of the same
+// package), and prefixed with the workspace roots whose dependency paths
+// reach any of those versions, such as:
+//
+//	myapp: serde: 2 versions, 1 avoidable (1.0.190 dominated by 1.0.195)
+func printDupSummary(pkgMap map[string]map[string]*Package) {
+	names := make([]string, 0, len(pkgMap))
+	for name, versions := range pkgMap {
+		if len(versions) > 1 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		versions := pkgMap[name]
+		var avoidable []*Package
+		owners := make(map[string]bool)
+		for _, pkg := range versions {
+			if pkg.avoidable {
+				avoidable = append(avoidable, pkg)
+			}
+			for _, path := range rootPaths(pkg) {
+				if path[0].isWorkspaceRoot {
+					owners[path[0].Name] = true
+				}
+			}
+		}
+		line := fmt.Sprintf("%s: %d versions", name, len(versions))
+		if len(avoidable) > 0 {
+			line += fmt.Sprintf(", %d avoidable (%s dominated by %s)",
+				len(avoidable), avoidable[0].Ver, avoidable[0].dominatedBy)
+		}
+		if len(owners) > 0 {
+			ownerNames := make([]string, 0, len(owners))
+			for o := range owners {
+				ownerNames = append(ownerNames, o)
+			}
+			sort.Strings(ownerNames)
+			line = strings.Join(ownerNames, ", ") + ": " + line
+		}
+		fmt.Println(line)
 	}
 }
 
@@ -198,12 +446,36 @@ func makePkgMap(pkgList []*Package) map[string]map[string]*Package {
 	}
 	for _, pkg := range pkgList {
 		pkg.versions = len(pkgs[pkg.Name])
-		for i, dep := range pkg.Deps {
-			d := pkgs[dep.Name]
-			p := d[dep.Ver]
-			pkg.Deps[i].Pkg = p
+		resolved := pkg.Deps[:0]
+		for _, dep := range pkg.Deps {
+			if dep.Ver == "" {
+				// v2+ lockfiles omit the version when the name alone is
+				// unambiguous; resolve it against the sole matching
+				// package.
+				candidates := pkgs[dep.Name]
+				if len(candidates) == 1 {
+					for v := range candidates {
+						dep.Ver = v
+					}
+				} else {
+					fmt.Fprintln(os.Stderr, "ambiguous dependency", dep.Name,
+						"of", pkg.Name, pkg.Ver, "-", len(candidates),
+						"candidate versions; skipping")
+					continue
+				}
+			}
+			p := pkgs[dep.Name][dep.Ver]
+			if p == nil {
+				fmt.Fprintln(os.Stderr, "unresolved dependency", dep.Name,
+					dep.Ver, "of", pkg.Name, pkg.Ver)
+				continue
+			}
+			dep.Pkg = p
 			p.incoming++
+			p.dependents = append(p.dependents, pkg)
+			resolved = append(resolved, dep)
 		}
+		pkg.Deps = resolved
 	}
 	for _, pkg := range pkgList {
 		if pkg.versions > 1 {
@@ -216,6 +488,33 @@ func makePkgMap(pkgList []*Package) map[string]map[string]*Package {
 			}
 			pkg.popular = pkg.incoming > maxIncoming
 		}
+		pkg.compatBucket = pkg.computeCompatBucket()
+	}
+	for _, versions := range pkgs {
+		if len(versions) < 2 {
+			continue
+		}
+		buckets := make(map[string][]*Package, len(versions))
+		for _, pkg := range versions {
+			buckets[pkg.compatBucket] = append(buckets[pkg.compatBucket], pkg)
+		}
+		for _, bucket := range buckets {
+			if len(bucket) < 2 {
+				continue
+			}
+			newest := bucket[0]
+			for _, pkg := range bucket[1:] {
+				if semverLess(newest.Ver, pkg.Ver) {
+					newest = pkg
+				}
+			}
+			for _, pkg := range bucket {
+				if pkg != newest {
+					pkg.avoidable = true
+					pkg.dominatedBy = newest.Ver
+				}
+			}
+		}
 	}
 	change := true
 	for change {
@@ -244,6 +543,7 @@ func makePkgMap(pkgList []*Package) map[string]map[string]*Package {
 }
 
 func trimPkgs(pkgs map[string]map[string]*Package, pkgList []*Package) []*Package {
+	keep := reachableFromRoots(pkgList)
 	anyChange := false
 	change := true
 	for change {
@@ -260,7 +560,7 @@ func trimPkgs(pkgs map[string]map[string]*Package, pkgList []*Package) []*Packag
 				pkg.Deps = newDeps
 			}
 			v, ok := pkgs[pkg.Name]
-			if ok && len(v) < 2 && len(pkg.Deps) == 0 {
+			if ok && len(v) < 2 && len(pkg.Deps) == 0 && !keep[pkg] {
 				fmt.Fprintln(os.Stderr, "removing", pkg.Name, "from the graph")
 				delete(pkgs, pkg.Name)
 				change = true
@@ -280,21 +580,48 @@ func trimPkgs(pkgs map[string]map[string]*Package, pkgList []*Package) []*Packag
 	return newPkgs
 }
 
+// reachableFromRoots returns every package forward-reachable from a
+// workspace root by following pkg.Deps, including the roots themselves.
+// -trim exempts this whole set, not just the roots, so that a root's
+// dependency chain isn't pruned down to a disconnected, useless node
+// just because nothing along it happens to be duplicated.
+func reachableFromRoots(pkgList []*Package) map[*Package]bool {
+	reachable := make(map[*Package]bool)
+	var queue []*Package
+	for _, pkg := range pkgList {
+		if pkg.isWorkspaceRoot {
+			queue = append(queue, pkg)
+			reachable[pkg] = true
+		}
+	}
+	for len(queue) > 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		for _, dep := range pkg.Deps {
+			if dep.Pkg != nil && !reachable[dep.Pkg] {
+				reachable[dep.Pkg] = true
+				queue = append(queue, dep.Pkg)
+			}
+		}
+	}
+	return reachable
+}
+
 // panicing convenience wrapper for WriteString.
-func writeString(w *os.File, s string) {
-	if _, err := w.WriteString(s); err != nil {
+func writeString(w io.Writer, s string) {
+	if _, err := io.WriteString(w, s); err != nil {
 		panic(err)
 	}
 }
 
-func writeDot(pkgs []*Package, baseurl string, w *os.File) {
+func writeDot(pkgs []*Package, baseurl string, reqs map[string]map[string]string, w io.Writer) {
 	writeString(w, "digraph crates {\n")
 	writeDotNodes(pkgs, baseurl, w)
-	writeDotEdges(pkgs, w)
+	writeDotEdges(pkgs, reqs, w)
 	writeString(w, "}\n")
 }
 
-func writeDotNodes(pkgs []*Package, baseurl string, w *os.File) {
+func writeDotNodes(pkgs []*Package, baseurl string, w io.Writer) {
 	pkgNames := make(map[string][]*Package, len(pkgs))
 	for _, pkg := range pkgs {
 		pkgNames[pkg.Name] = append(pkgNames[pkg.Name], pkg)
@@ -331,13 +658,41 @@ func writeDotNodes(pkgs []*Package, baseurl string, w *os.File) {
 	}
 }
 
-func (pkg *Package) writeDotId(w *os.File) {
-	writeString(w, pkg.Name)
-	writeString(w, "@")
-	writeString(w, pkg.Ver)
+func (pkg *Package) writeDotId(w io.Writer) {
+	writeString(w, pkg.dotID())
+}
+
+// dotID is the node identifier used for this package in dot output and in
+// the "from"/"to" fields of -json edges.
+func (pkg *Package) dotID() string {
+	return pkg.Name + "@" + pkg.Ver
+}
+
+// edgeKind classifies a dependency edge from pkg to dep the same way the
+// dot backend colors it, for use by both -dot and -json:
+//
+//   - "bringsInDup": pkg has a single version and isn't itself a
+//     dependency of a duplicated package, but dep does have more than one
+//     version.
+//   - "dupToDup": dep has more than one version, and pkg is already
+//     implicated in some other duplication (a direct sibling case of
+//     bringsInDup is excluded above).
+//   - "inDupCluster": pkg has more than one version, but dep does not.
+//   - "normal": neither pkg nor dep is part of a duplication.
+func edgeKind(pkg, dep *Package) string {
+	switch {
+	case pkg.versions == 1 && !pkg.depOfMulti && dep.versions > 1:
+		return "bringsInDup"
+	case dep.versions > 1:
+		return "dupToDup"
+	case pkg.versions > 1:
+		return "inDupCluster"
+	default:
+		return "normal"
+	}
 }
 
-func (pkg *Package) writeNodeDotAttrs(w *os.File, baseurl string) {
+func (pkg *Package) writeNodeDotAttrs(w io.Writer, baseurl string) {
 	writeString(w, `[id="`)
 	writeString(w, pkg.Name)
 	if pkg.versions > 1 {
@@ -345,50 +700,615 @@ func (pkg *Package) writeNodeDotAttrs(w *os.File, baseurl string) {
 		writeString(w, pkg.Ver)
 		writeString(w, `"; label="`)
 		writeString(w, pkg.Ver)
-		writeString(w, `"; shape="box`)
-	} else if pkg.Src == "" {
+		if pkg.avoidable {
+			writeString(w, `"; shape="hexagon`)
+		} else {
+			writeString(w, `"; shape="box`)
+		}
+	} else if pkg.isWorkspaceRoot {
 		writeString(w, `"; label="`)
 		writeString(w, pkg.Name)
 	}
 	writeString(w, `"; URL="`)
 	pkg.WriteUrl(w, true, baseurl)
+	writeString(w, `"`)
+	if pkg.Checksum != "" || pkg.avoidable {
+		writeString(w, `; tooltip="`)
+		if pkg.Checksum != "" {
+			writeString(w, "sha256:")
+			writeString(w, pkg.Checksum)
+		}
+		if pkg.avoidable {
+			if pkg.Checksum != "" {
+				writeString(w, "; ")
+			}
+			writeString(w, "avoidable, dominated by ")
+			writeString(w, pkg.dominatedBy)
+		}
+		writeString(w, `"`)
+	}
 	if pkg.versions == 1 && pkg.depVersions > 1 && !pkg.depOfMulti {
-		writeString(w, "\"; color=\"blue\"; style=\"filled\"; fillcolor=\"yellow")
+		writeString(w, `; color="blue"; style="filled"; fillcolor="yellow"`)
 	} else if pkg.versions > 1 && !pkg.depOfMulti {
-		writeString(w, "\"; color=\"red")
+		writeString(w, `; color="red"`)
 	} else if pkg.versions > 1 {
-		writeString(w, "\"; color=\"orange")
+		writeString(w, `; color="orange"`)
 	} else if pkg.depOfMulti && !pkg.popular {
-		writeString(w, "\"; color=\"yellow")
+		writeString(w, `; color="yellow"`)
 	}
-	writeString(w, "\"];\n")
+	writeString(w, "];\n")
 }
 
-func writeDotEdges(pkgs []*Package, w *os.File) {
+func writeDotEdges(pkgs []*Package, reqs map[string]map[string]string, w io.Writer) {
 	for _, pkg := range pkgs {
-		pkg.writeDotEdges(w)
+		pkg.writeDotEdges(reqs, w)
 	}
 }
 
-func (pkg *Package) writeDotEdges(w *os.File) {
+func (pkg *Package) writeDotEdges(reqs map[string]map[string]string, w io.Writer) {
 	for _, dep := range pkg.Deps {
 		writeString(w, "  ")
 		writeString(w, `"`)
 		pkg.writeDotId(w)
 		writeString(w, "\" -> \"")
 		dep.Pkg.writeDotId(w)
-		if pkg.versions == 1 && !pkg.depOfMulti && dep.Pkg.versions > 1 {
+		writeString(w, `"`)
+		switch edgeKind(pkg, dep.Pkg) {
+		case "bringsInDup":
 			if dep.Pkg.popular {
-				writeString(w, "\" [color=\"blue\"; penwidth=2];\n")
+				writeString(w, ` [color="blue"; penwidth=2`)
 			} else {
-				writeString(w, "\" [color=\"red\"; penwidth=3];\n")
+				writeString(w, ` [color="red"; penwidth=3`)
+			}
+		case "dupToDup":
+			writeString(w, ` [color="orange"`)
+		case "inDupCluster":
+			writeString(w, ` [color="blue"`)
+		default:
+			writeString(w, ` [penwidth=1.5`)
+		}
+		if req := reqs[pkg.Name][dep.Pkg.Name]; req != "" {
+			writeString(w, `; label="`)
+			writeString(w, req)
+			writeString(w, `"`)
+		}
+		writeString(w, "];\n")
+	}
+}
+
+// jsonPackage is the -json representation of a single resolved package.
+type jsonPackage struct {
+	Name            string `json:"name"`
+	Version         string `json:"version"`
+	Source          string `json:"source,omitempty"`
+	Checksum        string `json:"checksum,omitempty"`
+	URL             string `json:"url"`
+	Versions        int    `json:"versions"`
+	Incoming        int    `json:"incoming"`
+	Popular         bool   `json:"popular"`
+	DepOfMulti      bool   `json:"depOfMulti"`
+	DepVersions     int    `json:"depVersions"`
+	IsWorkspaceRoot bool   `json:"isWorkspaceRoot"`
+}
+
+// jsonEdge is the -json representation of a dependency edge.  Kind is one
+// of "normal", "bringsInDup", "dupToDup" or "inDupCluster"; see edgeKind.
+type jsonEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// jsonGraph is the top-level -json document: the fully-resolved graph, so
+// that tools consuming it don't need to re-implement makePkgMap.
+type jsonGraph struct {
+	Packages []jsonPackage `json:"packages"`
+	Edges    []jsonEdge    `json:"edges"`
+}
+
+// writeJSON renders the fully-resolved deps graph as JSON to w.
+func writeJSON(pkgs []*Package, baseurl string, w io.Writer) error {
+	graph := buildGraph(pkgs, baseurl)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&graph)
+}
+
+// buildGraph resolves pkgs into the -json/-html wire format shared by
+// writeJSON and writeHTML.
+func buildGraph(pkgs []*Package, baseurl string) jsonGraph {
+	graph := jsonGraph{
+		Packages: make([]jsonPackage, 0, len(pkgs)),
+	}
+	for _, pkg := range pkgs {
+		var url bytes.Buffer
+		pkg.WriteUrl(&url, true, baseurl)
+		graph.Packages = append(graph.Packages, jsonPackage{
+			Name:            pkg.Name,
+			Version:         pkg.Ver,
+			Source:          pkg.Src,
+			Checksum:        pkg.Checksum,
+			URL:             url.String(),
+			Versions:        pkg.versions,
+			Incoming:        pkg.incoming,
+			Popular:         pkg.popular,
+			DepOfMulti:      pkg.depOfMulti,
+			DepVersions:     pkg.depVersions,
+			IsWorkspaceRoot: pkg.isWorkspaceRoot,
+		})
+		for _, dep := range pkg.Deps {
+			graph.Edges = append(graph.Edges, jsonEdge{
+				From: pkg.dotID(),
+				To:   dep.Pkg.dotID(),
+				Kind: edgeKind(pkg, dep.Pkg),
+			})
+		}
+	}
+	return graph
+}
+
+// parseManifests walks dir recursively for Cargo.toml manifests and
+// extracts the semver requirement each package declares for its
+// dependencies, keyed first by the declaring package's name and then by
+// the dependency's name.
+func parseManifests(dir string) (map[string]map[string]string, error) {
+	reqs := make(map[string]map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Base(path) != "Cargo.toml" {
+			return nil
+		}
+		tree, err := toml.LoadFile(path)
+		if err != nil {
+			return err
+		}
+		name, _ := tree.Get("package.name").(string)
+		if name == "" {
+			return nil
+		}
+		for _, table := range []string{"dependencies", "dev-dependencies", "build-dependencies"} {
+			deps, ok := tree.Get(table).(*toml.Tree)
+			if !ok {
+				continue
+			}
+			for _, depName := range deps.Keys() {
+				var req string
+				switch v := deps.Get(depName).(type) {
+				case string:
+					req = v
+				case *toml.Tree:
+					req, _ = v.Get("version").(string)
+				}
+				if req == "" {
+					continue
+				}
+				if reqs[name] == nil {
+					reqs[name] = make(map[string]string)
+				}
+				reqs[name][depName] = req
+			}
+		}
+		return nil
+	})
+	return reqs, err
+}
+
+// parseWorkspace reads the root Cargo.toml in dir and returns the set of
+// package names that are members of the workspace: the root package
+// itself, if any, plus whatever the workspace.members and
+// workspace.default-members globs expand to.
+func parseWorkspace(dir string) (map[string]bool, error) {
+	tree, err := toml.LoadFile(filepath.Join(dir, "Cargo.toml"))
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	if name, ok := tree.Get("package.name").(string); ok && name != "" {
+		names[name] = true
+	}
+	var globs []string
+	globs = append(globs, workspaceGlobs(tree, "workspace.members")...)
+	globs = append(globs, workspaceGlobs(tree, "workspace.default-members")...)
+	for _, pattern := range globs {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			memberTree, err := toml.LoadFile(filepath.Join(match, "Cargo.toml"))
+			if err != nil {
+				continue
 			}
-		} else if dep.Pkg.versions > 1 {
-			writeString(w, "\" [color=\"orange\"];\n")
-		} else if pkg.versions > 1 {
-			writeString(w, "\" [color=\"blue\"];\n")
+			if name, ok := memberTree.Get("package.name").(string); ok && name != "" {
+				names[name] = true
+			}
+		}
+	}
+	return names, nil
+}
+
+// workspaceGlobs reads a string array at key from tree, ignoring the key
+// entirely if it is absent or not an array.
+func workspaceGlobs(tree *toml.Tree, key string) []string {
+	raw, ok := tree.Get(key).([]interface{})
+	if !ok {
+		return nil
+	}
+	globs := make([]string, 0, len(raw))
+	for _, v := range raw {
+		if s, ok := v.(string); ok {
+			globs = append(globs, s)
+		}
+	}
+	return globs
+}
+
+// markWorkspaceRoots sets isWorkspaceRoot on every package named in
+// workspaceNames.  If workspaceNames is nil (no -workspace flag given), it
+// falls back to the historical heuristic of treating any package with no
+// recorded source as a local workspace crate.
+func markWorkspaceRoots(pkgs []*Package, workspaceNames map[string]bool) {
+	for _, pkg := range pkgs {
+		if workspaceNames != nil {
+			pkg.isWorkspaceRoot = workspaceNames[pkg.Name]
 		} else {
-			writeString(w, "\" [penwidth=1.5];\n")
+			pkg.isWorkspaceRoot = pkg.Src == ""
 		}
 	}
 }
+
+// explainDups prints, for every package with more than one version, each
+// distinct path from a workspace root (a package with no incoming edges)
+// down to that package, annotating edges with the semver requirement that
+// produced them when known.
+func explainDups(pkgs []*Package, reqs map[string]map[string]string) {
+	for _, pkg := range pkgs {
+		if pkg.versions <= 1 {
+			continue
+		}
+		for _, path := range rootPaths(pkg) {
+			fmt.Println(formatPath(path, reqs))
+		}
+	}
+}
+
+// rootPaths returns every distinct path, starting at a workspace root (a
+// package with no incoming edges) and ending at pkg, found by walking
+// pkg.dependents in reverse breadth-first order. Cargo allows dependency
+// cycles through dev-dependencies, so a node already on the path being
+// built is never re-enqueued -- otherwise a cycle in dependents would
+// make the queue grow forever.
+func rootPaths(pkg *Package) [][]*Package {
+	type frame struct {
+		pkg    *Package
+		path   []*Package        // the path walked so far, root-first
+		onPath map[*Package]bool // pkg.dependents currently in path, for cycle detection
+	}
+	var paths [][]*Package
+	seen := make(map[string]bool)
+	queue := []frame{{pkg, []*Package{pkg}, map[*Package]bool{pkg: true}}}
+	for len(queue) > 0 {
+		f := queue[0]
+		queue = queue[1:]
+		if len(f.pkg.dependents) == 0 {
+			sig := pathSig(f.path)
+			if !seen[sig] {
+				seen[sig] = true
+				paths = append(paths, f.path)
+			}
+			continue
+		}
+		anyNew := false
+		for _, dependent := range f.pkg.dependents {
+			if f.onPath[dependent] {
+				continue
+			}
+			anyNew = true
+			path := make([]*Package, len(f.path)+1)
+			path[0] = dependent
+			copy(path[1:], f.path)
+			onPath := make(map[*Package]bool, len(f.onPath)+1)
+			for p := range f.onPath {
+				onPath[p] = true
+			}
+			onPath[dependent] = true
+			queue = append(queue, frame{dependent, path, onPath})
+		}
+		if !anyNew {
+			// Every dependent is already on this path -- a pure cycle
+			// with no way further back to a root. Report what we have
+			// rather than dropping the package silently.
+			sig := pathSig(f.path)
+			if !seen[sig] {
+				seen[sig] = true
+				paths = append(paths, f.path)
+			}
+		}
+	}
+	return paths
+}
+
+func pathSig(path []*Package) string {
+	var sb strings.Builder
+	for _, p := range path {
+		sb.WriteString(p.Name)
+		sb.WriteString("@")
+		sb.WriteString(p.Ver)
+		sb.WriteString(">")
+	}
+	return sb.String()
+}
+
+// formatPath renders a root-to-package path as e.g.
+// `root → a v1.2 → b v0.3 (requires "^0.3") → dup v2.0`, annotating each
+// package with the semver requirement (from reqs, when one is known) that
+// the previous package on the path declares for it.
+func formatPath(path []*Package, reqs map[string]map[string]string) string {
+	var sb strings.Builder
+	for i, p := range path {
+		if i > 0 {
+			sb.WriteString(" → ")
+		}
+		sb.WriteString(p.Name)
+		if i > 0 {
+			sb.WriteString(" v")
+			sb.WriteString(p.Ver)
+		}
+		if i > 0 {
+			if req := reqs[path[i-1].Name][p.Name]; req != "" {
+				sb.WriteString(` (requires "`)
+				sb.WriteString(req)
+				sb.WriteString(`")`)
+			}
+		}
+	}
+	return sb.String()
+}
+
+var (
+	validCrateName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	validVersion   = regexp.MustCompile(`^[A-Za-z0-9.+-]+$`)
+	validChecksum  = regexp.MustCompile(`^[A-Fa-f0-9]*$`)
+)
+
+// validateForHTML rejects any package whose Name, Ver or Checksum falls
+// outside what Cargo itself ever produces, or whose Src contains a quote,
+// angle bracket or backtick, before those fields get
+// concatenated into raw dot source. writeDotNodes/WriteUrl build dot
+// attribute strings by hand without escaping quotes, so a crate name
+// containing e.g. a `"` could break out of a dot attribute and inject
+// arbitrary SVG; -dot and -json pass such strings through too, but only
+// -html renders the result straight into a browser via template.HTML,
+// so only -html needs to refuse it outright.
+func validateForHTML(pkgs []*Package, reqs map[string]map[string]string) error {
+	for _, pkg := range pkgs {
+		if !validCrateName.MatchString(pkg.Name) {
+			return fmt.Errorf("refusing -html: invalid crate name %q", pkg.Name)
+		}
+		if !validVersion.MatchString(pkg.Ver) {
+			return fmt.Errorf("refusing -html: invalid version %q for %s", pkg.Ver, pkg.Name)
+		}
+		if !validChecksum.MatchString(pkg.Checksum) {
+			return fmt.Errorf("refusing -html: invalid checksum for %s@%s", pkg.Name, pkg.Ver)
+		}
+		if strings.ContainsAny(pkg.Src, "\"<>`") {
+			return fmt.Errorf("refusing -html: invalid source for %s@%s", pkg.Name, pkg.Ver)
+		}
+	}
+	// reqs holds semver requirement strings pulled straight out of
+	// Cargo.toml manifests by parseManifests -- just as untrusted as the
+	// lockfile fields above, and written into the same dot edge labels.
+	for from, deps := range reqs {
+		for to, req := range deps {
+			if strings.ContainsAny(req, "\"<>`") {
+				return fmt.Errorf("refusing -html: invalid requirement string for %s -> %s", from, to)
+			}
+		}
+	}
+	return nil
+}
+
+// writeHTML renders pkgs as a self-contained interactive HTML page: the
+// dot output is laid out and rendered to SVG by shelling out to
+// graphviz's `dot`, then inlined alongside a small JS layer that makes
+// multi-version clusters collapsible, highlights the paths from workspace
+// roots to a clicked duplicate (a client-side reverse walk like
+// -explain's), and greys out nodes that don't match a text
+// filter.
+func writeHTML(pkgs []*Package, baseurl string, reqs map[string]map[string]string, w io.Writer) error {
+	if err := validateForHTML(pkgs, reqs); err != nil {
+		return err
+	}
+
+	var dotSrc bytes.Buffer
+	writeDot(pkgs, baseurl, reqs, &dotSrc)
+
+	cmd := exec.Command("dot", "-Tsvg")
+	cmd.Stdin = &dotSrc
+	var svgOut, stderr bytes.Buffer
+	cmd.Stdout = &svgOut
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running `dot -Tsvg` (install graphviz for -html): %w: %s",
+			err, stderr.String())
+	}
+
+	graphJSON, err := json.Marshal(buildGraph(pkgs, baseurl))
+	if err != nil {
+		return err
+	}
+
+	return htmlTemplate.Execute(w, htmlData{
+		SVG:       template.HTML(extractSVG(svgOut.String())),
+		GraphJSON: template.JS(graphJSON),
+	})
+}
+
+// extractSVG trims the XML prolog and doctype that `dot -Tsvg` prefixes
+// its output with, leaving just the <svg>...</svg> element to embed.
+func extractSVG(out string) string {
+	if i := strings.Index(out, "<svg"); i >= 0 {
+		return out[i:]
+	}
+	return out
+}
+
+type htmlData struct {
+	SVG       template.HTML
+	GraphJSON template.JS
+}
+
+var htmlTemplate = template.Must(template.New("depsgraph").Parse(htmlTemplateSrc))
+
+const htmlTemplateSrc = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>deps graph</title>
+<style>
+  body { font-family: sans-serif; margin: 0; }
+  #toolbar {
+    padding: 0.5em 1em;
+    background: #eee;
+    position: sticky;
+    top: 0;
+  }
+  #graph { padding: 1em; }
+  #graph svg { max-width: 100%; height: auto; }
+  .node.faded, .cluster.faded { opacity: 0.15; }
+  .node.highlight polygon, .node.highlight ellipse {
+    stroke: #d62728;
+    stroke-width: 3;
+  }
+  .edge.highlight path { stroke: #d62728; stroke-width: 2; }
+  .edge.hidden, .node.hidden { display: none; }
+  .cluster { cursor: pointer; }
+  .cluster.collapsed .node { display: none; }
+</style>
+</head>
+<body>
+<div id="toolbar">
+  <input id="filter" type="text" placeholder="Filter crates by name...">
+</div>
+<div id="graph">{{.SVG}}</div>
+<script>
+(function() {
+  "use strict";
+  var graph = {{.GraphJSON}};
+  var svg = document.querySelector("#graph svg");
+  if (!svg) {
+    return;
+  }
+
+  var nodesByID = new Map();
+  svg.querySelectorAll("g.node").forEach(function(g) {
+    var title = g.querySelector("title");
+    if (title) {
+      nodesByID.set(title.textContent, g);
+    }
+  });
+
+  // dot's SVG output titles each edge "<tail>-><head>" using the same
+  // quoted node IDs as the dot source (name@version, which never
+  // contains ">"), so split on that literal rather than assuming
+  // g.edge elements come out in the same order as graph.edges -- dot is
+  // free to reorder edges within a cluster's subgraph, which is exactly
+  // the duplicate-version case this feature highlights.
+  var edges = [];
+  svg.querySelectorAll("g.edge").forEach(function(g) {
+    var title = g.querySelector("title");
+    if (!title) {
+      return;
+    }
+    var parts = title.textContent.split("->");
+    if (parts.length !== 2) {
+      return;
+    }
+    edges.push({el: g, from: parts[0], to: parts[1]});
+  });
+
+  var isWorkspaceRoot = new Map();
+  graph.packages.forEach(function(p) {
+    isWorkspaceRoot.set(p.name + "@" + p.version, !!p.isWorkspaceRoot);
+  });
+
+  // dependents: id -> [ids of packages that depend on it], mirroring the
+  // Package.dependents field the Go -explain walk uses.
+  var dependents = new Map();
+  edges.forEach(function(e) {
+    if (!dependents.has(e.to)) {
+      dependents.set(e.to, []);
+    }
+    dependents.get(e.to).push(e.from);
+  });
+
+  function clearHighlight() {
+    nodesByID.forEach(function(g) { g.classList.remove("highlight"); });
+    edges.forEach(function(e) { e.el.classList.remove("highlight"); });
+  }
+
+  // highlightPathsTo walks dependents in reverse breadth-first order from
+  // id back to every reachable workspace root, highlighting the nodes and
+  // edges it passes through.  Unlike -explain's walk in Go, which goes on
+  // to packages with no dependents, it stops at any node whose package is
+  // flagged isWorkspaceRoot.
+  function highlightPathsTo(id) {
+    clearHighlight();
+    var seen = new Set();
+    var queue = [id];
+    while (queue.length > 0) {
+      var cur = queue.shift();
+      if (seen.has(cur)) {
+        continue;
+      }
+      seen.add(cur);
+      var node = nodesByID.get(cur);
+      if (node) {
+        node.classList.add("highlight");
+      }
+      if (isWorkspaceRoot.get(cur)) {
+        continue;
+      }
+      (dependents.get(cur) || []).forEach(function(parent) {
+        queue.push(parent);
+      });
+    }
+    edges.forEach(function(e) {
+      if (seen.has(e.from) && seen.has(e.to)) {
+        e.el.classList.add("highlight");
+      }
+    });
+  }
+
+  nodesByID.forEach(function(g, id) {
+    g.addEventListener("click", function(ev) {
+      ev.stopPropagation();
+      highlightPathsTo(id);
+    });
+  });
+  document.getElementById("graph").addEventListener("click", clearHighlight);
+
+  svg.querySelectorAll("g.cluster").forEach(function(g) {
+    g.addEventListener("click", function(ev) {
+      g.classList.toggle("collapsed");
+      ev.stopPropagation();
+    });
+  });
+
+  document.getElementById("filter").addEventListener("input", function(ev) {
+    var q = ev.target.value.trim().toLowerCase();
+    nodesByID.forEach(function(g, id) {
+      if (!q || id.toLowerCase().indexOf(q) !== -1) {
+        g.classList.remove("faded");
+      } else {
+        g.classList.add("faded");
+      }
+    });
+  });
+})();
+</script>
+</body>
+</html>
+`